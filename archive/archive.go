@@ -15,15 +15,27 @@
 package archive
 
 import (
-	"github.com/getlantern/statshub/statshub"
+	"context"
 	"log"
 	"os"
+	"strings"
 	"time"
+
+	"github.com/getlantern/statshub/archive/sinks/bigquery"
+	"github.com/getlantern/statshub/archive/sinks/postgres"
+	"github.com/getlantern/statshub/archive/sinks/s3"
+	"github.com/getlantern/statshub/archive/sinks/webhook"
+	"github.com/getlantern/statshub/statshub"
 )
 
 const (
 	GOOGLE_PROJECT = "GOOGLE_PROJECT"
 
+	// STATSHUB_SINKS is a comma-separated list of archive sinks to
+	// enable, e.g. "bigquery,postgres". Each name must have its own
+	// configuration available in the environment (see configuredSinks).
+	STATSHUB_SINKS = "STATSHUB_SINKS"
+
 	datasetId = "statshub"
 )
 
@@ -35,43 +47,106 @@ var (
 	infrequentlyArchivedDimensions = []string{"user"}
 )
 
-// Start starts a goroutine that continuously archives data at regular intervals
-// based on the archiveInterval constant.
+// Start starts a goroutine per configured archive sink and dimension
+// that continuously archives data at a fixed interval per dimension:
+// fallback every 10 minutes, country hourly and user daily.
 func Start() {
-	if projectId == "" {
-		log.Println("No GOOGLE_PROJECT environment variable set, not archiving to BigQuery")
-	} else {
-		log.Printf("Archiving to BigQuery at %s", projectId)
-		archivePeriodically("fallback", 10*time.Minute)
-		archivePeriodically("country", 1*time.Hour)
-		archivePeriodically("user", 24*time.Hour)
+	sinks := configuredSinks()
+	if len(sinks) == 0 {
+		log.Println("No archive sinks configured in STATSHUB_SINKS, not archiving")
+		return
+	}
+
+	for _, sink := range sinks {
+		log.Printf("Archiving to %s", sink.Name())
+		archivePeriodically(sink, "fallback", 10*time.Minute)
+		archivePeriodically(sink, "country", 1*time.Hour)
+		archivePeriodically(sink, "user", 24*time.Hour)
+	}
+}
+
+// configuredSinks builds the ArchiveSink list named in STATSHUB_SINKS,
+// skipping (and logging) any sink whose own configuration is missing or
+// invalid rather than failing the whole process.
+func configuredSinks() []ArchiveSink {
+	names := strings.Split(os.Getenv(STATSHUB_SINKS), ",")
+	sinks := make([]ArchiveSink, 0, len(names))
+
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case "":
+			// tolerate an empty or trailing entry
+		case "bigquery":
+			if projectId == "" {
+				log.Println("No GOOGLE_PROJECT environment variable set, skipping bigquery sink")
+				continue
+			}
+			sinks = append(sinks, bigquery.New(projectId, datasetId))
+		case "postgres":
+			sink, err := postgres.New(os.Getenv("STATSHUB_POSTGRES_URL"))
+			if err != nil {
+				log.Printf("Unable to configure postgres sink: %s", err)
+				continue
+			}
+			sinks = append(sinks, sink)
+		case "s3":
+			bucket := os.Getenv("STATSHUB_S3_BUCKET")
+			if bucket == "" {
+				log.Println("No STATSHUB_S3_BUCKET environment variable set, skipping s3 sink")
+				continue
+			}
+			sinks = append(sinks, s3.New(bucket))
+		case "webhook":
+			url := os.Getenv("STATSHUB_WEBHOOK_URL")
+			if url == "" {
+				log.Println("No STATSHUB_WEBHOOK_URL environment variable set, skipping webhook sink")
+				continue
+			}
+			sinks = append(sinks, webhook.New(url))
+		default:
+			log.Printf("Unknown archive sink %q, ignoring", name)
+		}
 	}
+
+	return sinks
 }
 
-func archivePeriodically(dim string, interval time.Duration) {
+// archivePeriodically runs a goroutine that archives dim to sink once
+// per interval. Each tick gets its own cancellable context; if a tick is
+// still running when the next one comes due (e.g. QueryDims is slow),
+// that previous tick is canceled rather than left to race the new one.
+func archivePeriodically(sink ArchiveSink, dim string, interval time.Duration) {
 	go func() {
+		var cancelPrevious context.CancelFunc
 		for {
 			nextInterval := time.Now().Truncate(interval).Add(interval)
 			waitTime := nextInterval.Sub(time.Now())
 			time.Sleep(waitTime)
-			if err := archiveToBigQuery(dim, interval); err != nil {
-				log.Printf("Unable to archive dimension %s to BigQuery: %s", dim, err)
+
+			if cancelPrevious != nil {
+				cancelPrevious()
 			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancelPrevious = cancel
+
+			go func() {
+				if err := archiveToSink(ctx, sink, dim, interval); err != nil {
+					log.Printf("Unable to archive dimension %s to %s: %s", dim, sink.Name(), err)
+				}
+			}()
 		}
 	}()
 }
 
-func archiveToBigQuery(dim string, interval time.Duration) error {
-	if statsByDim, err := statshub.QueryDims([]string{dim}); err != nil {
+func archiveToSink(ctx context.Context, sink ArchiveSink, dim string, interval time.Duration) error {
+	statsByDim, err := statshub.QueryDims(ctx, []string{dim})
+	if err != nil {
 		return err
-	} else {
-		for dimName, dimStats := range statsByDim {
-			if statsTable, err := NewStatsTable(projectId, datasetId, dimName); err != nil {
-				return err
-			} else {
-				return statsTable.WriteStats(dimStats, time.Now().Truncate(interval))
-			}
+	}
+	for dimName, dimStats := range statsByDim {
+		if err := sink.WriteStats(dimName, dimStats, time.Now().Truncate(interval)); err != nil {
+			return err
 		}
-		return nil
 	}
+	return nil
 }
@@ -0,0 +1,36 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package archive
+
+import (
+	"time"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+// ArchiveSink is implemented by anything that can durably persist a
+// snapshot of dimensioned stats, such as BigQuery, Postgres, S3 or a
+// webhook. Start fans out every archive tick to each configured sink.
+type ArchiveSink interface {
+	// WriteStats persists stats for dimension dim (e.g. "country"),
+	// keyed by dimension value, as of ts.
+	WriteStats(dim string, stats map[string]*statshub.Stats, ts time.Time) error
+
+	// Name identifies the sink, for logging.
+	Name() string
+
+	// Close releases any resources held by the sink.
+	Close() error
+}
@@ -0,0 +1,58 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// package bigquery implements an archive.ArchiveSink that writes
+// dimensioned stats to Google BigQuery, one table per dimension (e.g.
+// one "country" table holding a row per country code).
+package bigquery
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+// Sink archives stats to BigQuery.
+type Sink struct {
+	projectId string
+	datasetId string
+}
+
+// New returns an ArchiveSink that archives into the given BigQuery
+// project and dataset.
+func New(projectId, datasetId string) *Sink {
+	return &Sink{projectId: projectId, datasetId: datasetId}
+}
+
+func (s *Sink) Name() string {
+	return "bigquery"
+}
+
+// WriteStats writes stats for every value of dimension dim into dim's
+// single BigQuery table, one row per value.
+func (s *Sink) WriteStats(dim string, statsByValue map[string]*statshub.Stats, ts time.Time) error {
+	table, err := NewStatsTable(s.projectId, s.datasetId, dim)
+	if err != nil {
+		return fmt.Errorf("Unable to open BigQuery table for %s: %s", dim, err)
+	}
+	if err := table.WriteStats(statsByValue, ts); err != nil {
+		return fmt.Errorf("Unable to write stats for %s to BigQuery: %s", dim, err)
+	}
+	return nil
+}
+
+func (s *Sink) Close() error {
+	return nil
+}
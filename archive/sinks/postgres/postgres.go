@@ -0,0 +1,81 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// package postgres implements an archive.ArchiveSink that upserts
+// dimensioned stats into a Postgres table, for deployments that would
+// rather not depend on BigQuery.
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+// Sink archives stats into a Postgres "stats" table, upserting on the
+// (dim, key, kind, name, ts) tuple so that reprocessing a tick is safe.
+type Sink struct {
+	db *sql.DB
+}
+
+// New opens a Postgres sink against connString (a standard
+// lib/pq connection string or URL).
+func New(connString string) (*Sink, error) {
+	db, err := sql.Open("postgres", connString)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open postgres connection: %s", err)
+	}
+	return &Sink{db: db}, nil
+}
+
+func (s *Sink) Name() string {
+	return "postgres"
+}
+
+func (s *Sink) WriteStats(dim string, statsByValue map[string]*statshub.Stats, ts time.Time) error {
+	for value, stats := range statsByValue {
+		if err := s.upsert(dim, value, "counter", stats.Counter, ts); err != nil {
+			return err
+		}
+		if err := s.upsert(dim, value, "gauge", stats.Gauge, ts); err != nil {
+			return err
+		}
+		if err := s.upsert(dim, value, "presence", stats.Presence, ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sink) upsert(dim, key, kind string, amounts map[string]int64, ts time.Time) error {
+	for name, amount := range amounts {
+		_, err := s.db.Exec(`
+			INSERT INTO stats (dim, key, kind, name, amount, ts)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (dim, key, kind, name, ts) DO UPDATE SET amount = EXCLUDED.amount
+		`, dim, key, kind, name, amount, ts)
+		if err != nil {
+			return fmt.Errorf("Unable to upsert %s %s for %s=%s: %s", kind, name, dim, key, err)
+		}
+	}
+	return nil
+}
+
+func (s *Sink) Close() error {
+	return s.db.Close()
+}
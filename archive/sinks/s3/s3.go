@@ -0,0 +1,138 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// package s3 implements an archive.ArchiveSink that batches dimensioned
+// stats into newline-delimited, gzip-compressed JSON objects in S3, one
+// object per dimension/date/hour.
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+// Sink accumulates every tick's stats in memory, keyed by the object
+// they'll eventually be written to, so that dimensions ticking more
+// than once per hour (e.g. "fallback", every 10 minutes) have their
+// ticks appended into the same object instead of overwriting one
+// another. A key is only flushed to its S3 object,
+// "dim=<dim>/date=<yyyy-mm-dd>/hour=<hh>.jsonl.gz", once ts rolls over
+// into the next key for that dimension.
+type Sink struct {
+	bucket *s3.Bucket
+
+	mutex        sync.Mutex
+	buffered     map[string]*bytes.Buffer
+	lastKeyByDim map[string]string
+}
+
+// New returns an ArchiveSink that writes into the given S3 bucket, using
+// credentials from the environment (AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY).
+func New(bucketName string) *Sink {
+	auth, _ := aws.EnvAuth()
+	client := s3.New(auth, aws.USEast)
+	return &Sink{
+		bucket:       client.Bucket(bucketName),
+		buffered:     make(map[string]*bytes.Buffer),
+		lastKeyByDim: make(map[string]string),
+	}
+}
+
+func (s *Sink) Name() string {
+	return "s3"
+}
+
+// WriteStats appends one JSON line to the buffer for dim's current
+// object key, flushing the previous key to S3 once ts rolls over into a
+// new one, so that a dimension ticking several times within the same
+// hour accumulates all of those ticks into a single object.
+func (s *Sink) WriteStats(dim string, statsByValue map[string]*statshub.Stats, ts time.Time) error {
+	key := objectKey(dim, ts)
+
+	line, err := json.Marshal(statsByValue)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal stats: %s", err)
+	}
+
+	s.mutex.Lock()
+	previousKey, hadPrevious := s.lastKeyByDim[dim]
+	rolledOver := hadPrevious && previousKey != key
+	s.lastKeyByDim[dim] = key
+
+	buf, ok := s.buffered[key]
+	if !ok {
+		buf = &bytes.Buffer{}
+		s.buffered[key] = buf
+	}
+	buf.Write(line)
+	buf.WriteByte('\n')
+	s.mutex.Unlock()
+
+	if rolledOver {
+		return s.flush(previousKey)
+	}
+	return nil
+}
+
+func (s *Sink) flush(key string) error {
+	s.mutex.Lock()
+	buf, ok := s.buffered[key]
+	delete(s.buffered, key)
+	s.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	if _, err := writer.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("Unable to gzip stats: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("Unable to gzip stats: %s", err)
+	}
+
+	return s.bucket.Put(key, gzipped.Bytes(), "application/jsonl+gzip", s3.Private)
+}
+
+func objectKey(dim string, ts time.Time) string {
+	return fmt.Sprintf("dim=%s/date=%s/hour=%02d.jsonl.gz", dim, ts.Format("2006-01-02"), ts.Hour())
+}
+
+// Close flushes any buffered keys that haven't yet rolled over, so nothing
+// accumulated since the last flush is lost on shutdown.
+func (s *Sink) Close() error {
+	s.mutex.Lock()
+	keys := make([]string, 0, len(s.buffered))
+	for key := range s.buffered {
+		keys = append(keys, key)
+	}
+	s.mutex.Unlock()
+
+	for _, key := range keys {
+		if err := s.flush(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
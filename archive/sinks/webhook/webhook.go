@@ -0,0 +1,66 @@
+// Copyright 2014 Brave New Software
+
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+
+//        http://www.apache.org/licenses/LICENSE-2.0
+
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// package webhook implements an archive.ArchiveSink that POSTs the same
+// JSON shape getStats returns to an arbitrary HTTP endpoint.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/getlantern/statshub/statshub"
+)
+
+// Sink POSTs each tick's stats to a configured URL.
+type Sink struct {
+	url    string
+	client *http.Client
+}
+
+// New returns an ArchiveSink that POSTs to targetUrl.
+func New(targetUrl string) *Sink {
+	return &Sink{url: targetUrl, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (s *Sink) Name() string {
+	return "webhook"
+}
+
+func (s *Sink) WriteStats(dim string, statsByValue map[string]*statshub.Stats, ts time.Time) error {
+	body, err := json.Marshal(statsByValue)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal stats: %s", err)
+	}
+
+	target := s.url + "?" + url.Values{"dim": {dim}, "ts": {ts.Format(time.RFC3339)}}.Encode()
+	resp, err := s.client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to post stats to webhook: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *Sink) Close() error {
+	return nil
+}
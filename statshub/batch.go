@@ -0,0 +1,240 @@
+package statshub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// batchPipelineSizeEnv controls how many processed submissions are
+// buffered before their NDJSON results are flushed to the client,
+// trading latency-to-first-byte for fewer, larger writes.
+const batchPipelineSizeEnv = "STATSHUB_BATCH_PIPELINE_SIZE"
+
+const defaultBatchPipelineSize = 100
+
+// idempotencyTTL is how long a submitted IdempotencyKey is remembered,
+// long enough to cover a client retrying after a network failure without
+// growing the seen-keys set unboundedly.
+const idempotencyTTL = 24 * time.Hour
+
+// batchSubmission is a single line of a POST /stats/<userid>/batch
+// request body. It embeds StatsSubmission and adds an optional
+// IdempotencyKey that lets a retrying client avoid double-counting.
+type batchSubmission struct {
+	StatsSubmission
+	IdempotencyKey string
+}
+
+// batchResult is written back as one line of NDJSON per processed input
+// line. Results are flushed in groups of batchPipelineSize() lines, and
+// once more when the stream ends, not after each line.
+type batchResult struct {
+	Succeeded bool
+	Key       string `json:"key,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// batchStatsHandler handles POST /stats/<userid>/batch, accepting
+// newline-delimited JSON (one StatsSubmission per line, with an optional
+// IdempotencyKey) instead of the single-submission body that postStats
+// expects. This is much more efficient for clients that buffer stats
+// offline, such as mobile clients on flaky links or edge relays.
+func batchStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+
+	userInfo, err := batchUserInfo(r)
+	if err != nil {
+		fail(w, 400, err)
+		return
+	}
+
+	// Unlike statsHandler, batchStatsHandler doesn't impose
+	// requestTimeout(): a streamed batch can legitimately take far
+	// longer than a single submission. r.Context() is still passed to
+	// every Redis call; it carries no deadline, so doContext bounds each
+	// call by defaultRequestTimeout, and a client disconnecting does not
+	// interrupt a Redis command already in flight.
+	ctx := r.Context()
+
+	conn, err := connectToRedis(ctx)
+	if err != nil {
+		fail(w, 500, fmt.Errorf("Unable to connect to redis: %s", err))
+		return
+	}
+	defer conn.Close()
+
+	if statusCode, err := userInfo.authenticate(ctx, conn, r, ScopeSubmit); err != nil {
+		fail(w, statusCode, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	decoder := json.NewDecoder(r.Body)
+
+	pipelineSize := batchPipelineSize()
+	pending := 0
+	results := make([]batchResult, 0, pipelineSize)
+
+	flushPipeline := func() {
+		if pending == 0 {
+			return
+		}
+		for _, result := range results {
+			encoder.Encode(result)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		pending = 0
+		results = results[:0]
+	}
+
+	for {
+		submission := &batchSubmission{}
+		if err := decoder.Decode(submission); err != nil {
+			break
+		}
+
+		// Each line is charged against the same submit-scope bucket
+		// that statsHandler enforces, so a batch can't be used to
+		// bypass per-user rate limiting a line at a time. Once the
+		// bucket is exhausted, the rest of the stream is rejected
+		// without even being decoded, rather than accepted and
+		// silently throttled line by line.
+		_, retryAfter, err := userInfo.checkRateLimit(ctx, conn, ScopeSubmit, 1)
+		if err != nil {
+			results = append(results, batchResult{Succeeded: false, Key: submission.IdempotencyKey, Error: err.Error()})
+			pending++
+			flushPipeline()
+			break
+		}
+		if retryAfter > 0 {
+			results = append(results, batchResult{
+				Succeeded: false,
+				Key:       submission.IdempotencyKey,
+				Error:     fmt.Sprintf("Rate limited, retry after %s", retryAfter),
+			})
+			pending++
+			flushPipeline()
+			break
+		}
+
+		results = append(results, processBatchLine(ctx, conn, userInfo.UserId, submission))
+		pending++
+
+		if pending >= pipelineSize {
+			flushPipeline()
+		}
+	}
+
+	flushPipeline()
+}
+
+// processBatchLine applies a single submission, skipping it without
+// error if its IdempotencyKey has already been recorded. The
+// idempotency key is only recorded once postToRedis actually confirms
+// the write, so that a failed write is never mistaken for a duplicate
+// on retry: marking it seen before that would make a client's retry of
+// an exact failed submission look like a no-op instead of the retry it
+// needs to be.
+func processBatchLine(ctx context.Context, conn redis.Conn, userId int64, submission *batchSubmission) batchResult {
+	if submission.IdempotencyKey != "" {
+		seen, err := isSeen(ctx, conn, userId, submission.IdempotencyKey)
+		if err != nil {
+			return batchResult{Succeeded: false, Key: submission.IdempotencyKey, Error: err.Error()}
+		}
+		if seen {
+			return batchResult{Succeeded: true, Key: submission.IdempotencyKey}
+		}
+	}
+
+	if err := submission.StatsSubmission.postToRedis(ctx, conn, userId); err != nil {
+		return batchResult{Succeeded: false, Key: submission.IdempotencyKey, Error: err.Error()}
+	}
+
+	if submission.IdempotencyKey != "" {
+		if err := markSeen(ctx, conn, userId, submission.IdempotencyKey); err != nil {
+			return batchResult{Succeeded: false, Key: submission.IdempotencyKey, Error: err.Error()}
+		}
+	}
+
+	return batchResult{Succeeded: true, Key: submission.IdempotencyKey}
+}
+
+// isSeen reports whether key has already been recorded as seen for
+// userId, without recording anything itself, so that a line's write can
+// be attempted before it's committed to the idempotency set.
+func isSeen(ctx context.Context, conn redis.Conn, userId int64, key string) (bool, error) {
+	reply, err := doContext(ctx, conn, "SISMEMBER", idempotencyKey(userId), key)
+	if err != nil {
+		return false, fmt.Errorf("Unable to check idempotency key: %s", err)
+	}
+	seen, err := redis.Bool(reply, nil)
+	if err != nil {
+		return false, fmt.Errorf("Unable to check idempotency key: %s", err)
+	}
+	return seen, nil
+}
+
+// markSeen records key as seen for userId, called only once the write
+// it guards has actually been confirmed.
+func markSeen(ctx context.Context, conn redis.Conn, userId int64, key string) error {
+	if _, err := doContext(ctx, conn, "SADD", idempotencyKey(userId), key); err != nil {
+		return fmt.Errorf("Unable to set idempotency key: %s", err)
+	}
+	if _, err := doContext(ctx, conn, "EXPIRE", idempotencyKey(userId), int(idempotencyTTL.Seconds())); err != nil {
+		return fmt.Errorf("Unable to set idempotency key expiry: %s", err)
+	}
+	return nil
+}
+
+func idempotencyKey(userId int64) string {
+	return fmt.Sprintf("idempotency:%d", userId)
+}
+
+func batchPipelineSize() int {
+	if size := os.Getenv(batchPipelineSizeEnv); size != "" {
+		if parsed, err := strconv.Atoi(size); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return defaultBatchPipelineSize
+}
+
+// batchUserInfo is like getUserInfo, but parses a userid out of a
+// "/stats/<userid>/batch" path instead of "/stats/<userid>".
+func batchUserInfo(r *http.Request) (userInfo *UserInfo, err error) {
+	path := strings.TrimSuffix(r.URL.Path, "/batch")
+	lastSlash := strings.LastIndex(path, "/")
+	if lastSlash < 0 {
+		return nil, fmt.Errorf("Request URL is missing user id")
+	}
+	userIdString := path[lastSlash+1:]
+	userIdInt, err := strconv.Atoi(userIdString)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to convert userId %s to int: %s", userIdString, err)
+	}
+
+	userInfo = &UserInfo{UserId: int64(userIdInt)}
+
+	if hashes, ok := r.URL.Query()["hash"]; ok && len(hashes) == 1 {
+		userInfo.Hash = hashes[0]
+	}
+
+	return userInfo, nil
+}
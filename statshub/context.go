@@ -0,0 +1,69 @@
+package statshub
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// requestTimeoutEnv configures how long statsHandler gives a request
+// (including every Redis call it makes) before aborting it with a 504,
+// so a slow client or a stuck Redis command can't hold an appengine
+// instance until its own timeout.
+const requestTimeoutEnv = "STATSHUB_REQUEST_TIMEOUT_SECONDS"
+
+const defaultRequestTimeout = 5 * time.Second
+
+func requestTimeout() time.Duration {
+	if seconds := os.Getenv(requestTimeoutEnv); seconds != "" {
+		if parsed, err := strconv.Atoi(seconds); err == nil && parsed > 0 {
+			return time.Duration(parsed) * time.Second
+		}
+	}
+	return defaultRequestTimeout
+}
+
+// doContext runs a single Redis command honoring ctx's deadline. redigo
+// connections that also implement redis.ConnWithTimeout (the common
+// case) get DoWithTimeout directly; otherwise the command runs in a
+// goroutine and races against ctx.Done(), which at least stops the
+// caller from waiting past the deadline even though the underlying
+// command may still be in flight against Redis.
+func doContext(ctx context.Context, conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if cwt, ok := conn.(redis.ConnWithTimeout); ok {
+		timeout := defaultRequestTimeout
+		if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+			timeout = time.Until(deadline)
+		}
+		return cwt.DoWithTimeout(timeout, cmd, args...)
+	}
+
+	return raceContext(ctx, func() (interface{}, error) {
+		return conn.Do(cmd, args...)
+	})
+}
+
+// raceContext is doContext's goroutine-plus-cancel fallback, generalized
+// so other helpers (e.g. running a Lua script) can reuse it instead of
+// only accepting a plain command.
+func raceContext(ctx context.Context, fn func() (interface{}, error)) (interface{}, error) {
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reply, err := fn()
+		done <- result{reply, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-done:
+		return r.reply, r.err
+	}
+}
@@ -0,0 +1,203 @@
+package statshub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsCacheTTLEnv names the environment variable controlling how long
+// a rendered /metrics response is cached before QueryDims is called
+// again. QueryDims scans every dimensioned stat, so it's too expensive
+// to run on every scrape.
+const metricsCacheTTLEnv = "STATSHUB_METRICS_CACHE_SECONDS"
+
+// metricsAllowedIPsEnv names the environment variable holding a
+// comma-separated allowlist of IPs (or IP:port, the port is ignored)
+// that may scrape /metrics without a bearer token, so that a
+// Prometheus or Grafana Agent running alongside statshub doesn't need
+// its own token.
+const metricsAllowedIPsEnv = "STATSHUB_METRICS_ALLOW_IPS"
+
+// metricsDimensionsEnv names the environment variable holding a
+// comma-separated override of the dimensions exposed on /metrics, for
+// deployments that archive a different set of dimensions than the
+// default.
+const metricsDimensionsEnv = "STATSHUB_METRICS_DIMENSIONS"
+
+const defaultMetricsCacheTTL = 15 * time.Second
+
+// defaultMetricsDimensions lists the dimensions exposed on /metrics when
+// metricsDimensionsEnv isn't set. It mirrors the dimensions that the
+// archive package archives (fallback, country and user).
+var defaultMetricsDimensions = []string{"country", "fallback", "user"}
+
+var metricsCache = &struct {
+	sync.Mutex
+	renderedAt time.Time
+	body       []byte
+}{}
+
+func init() {
+	http.HandleFunc("/metrics", MetricsHandler)
+}
+
+// MetricsHandler serves the current stats in the Prometheus text
+// exposition format, so that a Prometheus server or Grafana Agent can
+// scrape statshub directly instead of waiting for the next archive run. The rendered output is cached for metricsCacheTTL()
+// because QueryDims is expensive.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout())
+	defer cancel()
+
+	if !isMetricsRequestAllowed(ctx, r) {
+		w.WriteHeader(403)
+		return
+	}
+
+	body, err := renderedMetrics(ctx)
+	if err != nil {
+		fail(w, statusCodeFor(ctx, 500), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(200)
+	w.Write(body)
+}
+
+// isMetricsRequestAllowed permits the request if it carries a bearer
+// token with the query scope, or if its remote IP is in the
+// STATSHUB_METRICS_ALLOW_IPS allowlist.
+func isMetricsRequestAllowed(ctx context.Context, r *http.Request) bool {
+	if tokenString := bearerToken(r); tokenString != "" {
+		conn, err := connectToRedis(ctx)
+		if err == nil {
+			defer conn.Close()
+			if token, err := lookupToken(ctx, conn, tokenString); err == nil && token != nil && token.hasScope(ScopeQuery) {
+				return true
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	for _, allowed := range strings.Split(os.Getenv(metricsAllowedIPsEnv), ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowedHost, _, err := net.SplitHostPort(allowed); err == nil {
+			allowed = allowedHost
+		}
+		if allowed != "" && allowed == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+func renderedMetrics(ctx context.Context) ([]byte, error) {
+	metricsCache.Lock()
+	defer metricsCache.Unlock()
+
+	if time.Since(metricsCache.renderedAt) < metricsCacheTTL() && metricsCache.body != nil {
+		return metricsCache.body, nil
+	}
+
+	statsByDim, err := QueryDims(ctx, metricsDimensions())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query stats: %s", err)
+	}
+
+	body := renderPrometheus(statsByDim)
+	metricsCache.body = body
+	metricsCache.renderedAt = time.Now()
+	return body, nil
+}
+
+func metricsCacheTTL() time.Duration {
+	if seconds := os.Getenv(metricsCacheTTLEnv); seconds != "" {
+		if parsed, err := strconv.Atoi(seconds); err == nil && parsed >= 0 {
+			return time.Duration(parsed) * time.Second
+		}
+	}
+	return defaultMetricsCacheTTL
+}
+
+func metricsDimensions() []string {
+	if dims := os.Getenv(metricsDimensionsEnv); dims != "" {
+		parts := strings.Split(dims, ",")
+		dimensions := make([]string, 0, len(parts))
+		for _, part := range parts {
+			if part = strings.TrimSpace(part); part != "" {
+				dimensions = append(dimensions, part)
+			}
+		}
+		if len(dimensions) > 0 {
+			return dimensions
+		}
+	}
+	return defaultMetricsDimensions
+}
+
+// renderPrometheus serializes per-dimension-value stats bundles into the
+// Prometheus text exposition format. Each dimension becomes a label
+// named after dim, counters and gauges become metrics of the
+// corresponding type, and presence maps are exposed as gauges (either a
+// key is present for a given dimension value or it isn't).
+func renderPrometheus(statsByDim map[string]map[string]*Stats) []byte {
+	families := map[string]struct {
+		metricType string
+		lines      []string
+	}{}
+
+	addSample := func(name, metricType, dim, value string, amount int64) {
+		family := families[name]
+		family.metricType = metricType
+		family.lines = append(family.lines, fmt.Sprintf("statshub_%s{dim=%q,value=%q} %d", name, dim, value, amount))
+		families[name] = family
+	}
+
+	for dim, statsByValue := range statsByDim {
+		for value, stats := range statsByValue {
+			for name, amount := range stats.Counter {
+				addSample(name, "counter", dim, value, amount)
+			}
+			for name, amount := range stats.Gauge {
+				addSample(name, "gauge", dim, value, amount)
+			}
+			for name, amount := range stats.Presence {
+				addSample(name, "gauge", dim, value, amount)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		family := families[name]
+		sort.Strings(family.lines)
+		fmt.Fprintf(&buf, "# HELP statshub_%s %s, as submitted to statshub.\n", name, name)
+		fmt.Fprintf(&buf, "# TYPE statshub_%s %s\n", name, family.metricType)
+		for _, line := range family.lines {
+			buf.WriteString(line)
+			buf.WriteString("\n")
+		}
+	}
+
+	return buf.Bytes()
+}
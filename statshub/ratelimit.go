@@ -0,0 +1,111 @@
+package statshub
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// rateLimitScript implements a classic Redis token bucket. It stores
+// {tokens, lastRefillMicros} in a hash at KEYS[1], refills
+// min(capacity, tokens + (now-last)*refillPerSec) tokens since the last
+// call, then either decrements by cost and returns the tokens remaining,
+// or returns -1 if there aren't enough tokens left. Running the whole
+// thing as a script keeps the refill-then-decrement sequence atomic
+// without a Redis transaction.
+//
+// KEYS[1] = bucket key
+// ARGV[1] = capacity
+// ARGV[2] = refillPerSec
+// ARGV[3] = now (microseconds)
+// ARGV[4] = cost
+var rateLimitScript = redis.NewScript(1, `
+local capacity = tonumber(ARGV[1])
+local refillPerSec = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'lastRefillMicros')
+local tokens = tonumber(bucket[1])
+local lastRefillMicros = tonumber(bucket[2])
+
+if tokens == nil then
+  tokens = capacity
+  lastRefillMicros = now
+end
+
+local elapsedSec = (now - lastRefillMicros) / 1000000
+if elapsedSec > 0 then
+  tokens = math.min(capacity, tokens + elapsedSec * refillPerSec)
+end
+
+local retryAfter = 0
+if tokens < cost then
+  retryAfter = math.ceil((cost - tokens) / refillPerSec)
+  redis.call('HMSET', KEYS[1], 'tokens', tokens, 'lastRefillMicros', now)
+  redis.call('EXPIRE', KEYS[1], math.ceil(capacity / refillPerSec) + 1)
+  return {-1, retryAfter}
+end
+
+tokens = tokens - cost
+redis.call('HMSET', KEYS[1], 'tokens', tokens, 'lastRefillMicros', now)
+redis.call('EXPIRE', KEYS[1], math.ceil(capacity / refillPerSec) + 1)
+return {tokens, 0}
+`)
+
+// rateLimitConfig holds the token bucket parameters for one scope.
+type rateLimitConfig struct {
+	capacity     int
+	refillPerSec float64
+}
+
+func rateLimitConfigFor(scope string) rateLimitConfig {
+	switch scope {
+	case ScopeSubmit:
+		capacity := envInt("STATSHUB_RATELIMIT_SUBMIT_CAPACITY", 60)
+		return rateLimitConfig{capacity: capacity, refillPerSec: float64(capacity) / 60}
+	case ScopeQuery:
+		capacity := envInt("STATSHUB_RATELIMIT_QUERY_CAPACITY", 10)
+		return rateLimitConfig{capacity: capacity, refillPerSec: float64(capacity) / 60}
+	default:
+		return rateLimitConfig{capacity: 60, refillPerSec: 1}
+	}
+}
+
+func envInt(name string, fallback int) int {
+	if value := os.Getenv(name); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+// checkRateLimit enforces a per-user, per-scope token bucket, consuming
+// cost tokens from it. remaining is the number of tokens left in the
+// bucket after this call (meaningless when err != nil or the bucket was
+// exhausted). retryAfter is how long the caller should wait before the
+// bucket would have enough tokens for this cost again.
+func (userInfo *UserInfo) checkRateLimit(ctx context.Context, conn redis.Conn, scope string, cost int) (remaining int, retryAfter time.Duration, err error) {
+	config := rateLimitConfigFor(scope)
+	key := fmt.Sprintf("ratelimit:%s:%d", scope, userInfo.UserId)
+
+	reply, err := raceContext(ctx, func() (interface{}, error) {
+		return rateLimitScript.Do(conn, key, config.capacity, config.refillPerSec, time.Now().UnixNano()/1000, cost)
+	})
+	result, err := redis.Ints(reply, err)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Unable to check rate limit: %s", err)
+	}
+
+	remaining = result[0]
+	retryAfter = time.Duration(result[1]) * time.Second
+	if remaining < 0 {
+		return 0, retryAfter, nil
+	}
+	return remaining, 0, nil
+}
@@ -0,0 +1,97 @@
+package statshub
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+)
+
+func newTestConn(t *testing.T) (*miniredis.Miniredis, redis.Conn) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Unable to start miniredis: %s", err)
+	}
+	t.Cleanup(mr.Close)
+
+	conn, err := redis.Dial("tcp", mr.Addr())
+	if err != nil {
+		t.Fatalf("Unable to dial miniredis: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return mr, conn
+}
+
+func TestCheckRateLimitRefillsAndBlocks(t *testing.T) {
+	_, conn := newTestConn(t)
+	ctx := context.Background()
+	userInfo := &UserInfo{UserId: 1}
+
+	config := rateLimitConfigFor(ScopeQuery)
+
+	for i := 0; i < config.capacity; i++ {
+		remaining, retryAfter, err := userInfo.checkRateLimit(ctx, conn, ScopeQuery, 1)
+		if err != nil {
+			t.Fatalf("checkRateLimit: %s", err)
+		}
+		if retryAfter != 0 {
+			t.Fatalf("expected bucket to have capacity left on request %d, got retryAfter=%s", i, retryAfter)
+		}
+		if remaining != config.capacity-i-1 {
+			t.Fatalf("expected %d tokens remaining, got %d", config.capacity-i-1, remaining)
+		}
+	}
+
+	// The bucket should now be exhausted and enforce a 429.
+	remaining, retryAfter, err := userInfo.checkRateLimit(ctx, conn, ScopeQuery, 1)
+	if err != nil {
+		t.Fatalf("checkRateLimit: %s", err)
+	}
+	if retryAfter <= 0 {
+		t.Fatalf("expected a positive retryAfter once the bucket is exhausted, got %s", retryAfter)
+	}
+	if remaining != 0 {
+		t.Fatalf("expected 0 tokens remaining once exhausted, got %d", remaining)
+	}
+
+	// Pretend the last refill was a minute ago: at capacity/60 tokens per
+	// second that refills the bucket to capacity, minus this call's cost.
+	key := fmt.Sprintf("ratelimit:%s:%d", ScopeQuery, userInfo.UserId)
+	if _, err := conn.Do("HSET", key, "lastRefillMicros", time.Now().Add(-time.Minute).UnixNano()/1000); err != nil {
+		t.Fatalf("HSET: %s", err)
+	}
+	remaining, retryAfter, err = userInfo.checkRateLimit(ctx, conn, ScopeQuery, 1)
+	if err != nil {
+		t.Fatalf("checkRateLimit: %s", err)
+	}
+	if retryAfter != 0 || remaining != config.capacity-1 {
+		t.Fatalf("expected %d tokens remaining after a full refill, got %d (retryAfter=%s)", config.capacity-1, remaining, retryAfter)
+	}
+}
+
+func TestCheckRateLimitIsPerUserAndScope(t *testing.T) {
+	_, conn := newTestConn(t)
+	ctx := context.Background()
+
+	config := rateLimitConfigFor(ScopeSubmit)
+
+	userA := &UserInfo{UserId: 1}
+	userB := &UserInfo{UserId: 2}
+
+	if _, retryAfter, err := userA.checkRateLimit(ctx, conn, ScopeSubmit, config.capacity); err != nil || retryAfter != 0 {
+		t.Fatalf("expected userA to be able to spend its whole bucket, got retryAfter=%s err=%v", retryAfter, err)
+	}
+	if _, retryAfter, err := userA.checkRateLimit(ctx, conn, ScopeSubmit, 1); err != nil || retryAfter <= 0 {
+		t.Fatalf("expected userA's bucket to now be exhausted, got retryAfter=%s err=%v", retryAfter, err)
+	}
+	if _, retryAfter, err := userB.checkRateLimit(ctx, conn, ScopeSubmit, 1); err != nil || retryAfter != 0 {
+		t.Fatalf("expected userB to have its own, unaffected bucket, got retryAfter=%s err=%v", retryAfter, err)
+	}
+	if _, retryAfter, err := userA.checkRateLimit(ctx, conn, ScopeQuery, 1); err != nil || retryAfter != 0 {
+		t.Fatalf("expected a different scope to have its own bucket, got retryAfter=%s err=%v", retryAfter, err)
+	}
+}
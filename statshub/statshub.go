@@ -15,6 +15,7 @@ package statshub
 import (
 	"appengine"
 	"appengine/user"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -23,6 +24,8 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 // UserInfo captures the UserId and authentication Hash for a request.
@@ -52,33 +55,66 @@ func init() {
 
 // statsPostHandler handles requests to /stats
 func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/batch") {
+		batchStatsHandler(w, r)
+		return
+	}
+
 	userInfo, err := getUserInfo(r)
 	if err != nil {
 		fail(w, 400, err)
 		return
 	}
 
-	statusCode, err := userInfo.authenticateAgainst(r)
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout())
+	defer cancel()
+
+	requiredScope := ScopeQuery
+	if "POST" == r.Method {
+		requiredScope = ScopeSubmit
+	}
+
+	conn, err := connectToRedis(ctx)
+	if err != nil {
+		fail(w, statusCodeFor(ctx, 500), fmt.Errorf("Unable to connect to redis: %s", err))
+		return
+	}
+	defer conn.Close()
+
+	statusCode, err := userInfo.authenticate(ctx, conn, r, requiredScope)
 	if err != nil {
-		fail(w, statusCode, err)
+		fail(w, statusCodeFor(ctx, statusCode), err)
+		return
+	}
+
+	remaining, retryAfter, err := userInfo.checkRateLimit(ctx, conn, requiredScope, 1)
+	if err != nil {
+		fail(w, statusCodeFor(ctx, 500), err)
+		return
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.WriteHeader(429)
 		return
 	}
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
 
 	if "POST" == r.Method {
 		w.Header().Set("Content-Type", "application/json")
 
-		statusCode, resp, err := postStats(r, userInfo)
+		statusCode, resp, err := postStats(ctx, r, userInfo)
 		if err != nil {
-			fail(w, statusCode, err)
+			fail(w, statusCodeFor(ctx, statusCode), err)
 		} else {
 			write(w, 200, resp)
 		}
 	} else if "GET" == r.Method {
 		w.Header().Set("Content-Type", "application/json")
 
-		statusCode, resp, err := getStats(r, userInfo)
+		statusCode, resp, err := getStats(ctx, r, userInfo)
 		if err != nil {
-			fail(w, statusCode, err)
+			fail(w, statusCodeFor(ctx, statusCode), err)
 		} else {
 			write(w, 200, resp)
 		}
@@ -88,8 +124,19 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// statusCodeFor overrides fallback with 504 when ctx's deadline is what
+// actually caused the preceding call to fail, so a slow client or a
+// stuck Redis command is reported as a timeout rather than a generic
+// server error.
+func statusCodeFor(ctx context.Context, fallback int) int {
+	if ctx.Err() == context.DeadlineExceeded {
+		return 504
+	}
+	return fallback
+}
+
 // postStats handles a POST request to /stats
-func postStats(r *http.Request, userInfo *UserInfo) (statusCode int, resp interface{}, err error) {
+func postStats(ctx context.Context, r *http.Request, userInfo *UserInfo) (statusCode int, resp interface{}, err error) {
 	decoder := json.NewDecoder(r.Body)
 	stats := &StatsSubmission{}
 	err = decoder.Decode(stats)
@@ -97,7 +144,13 @@ func postStats(r *http.Request, userInfo *UserInfo) (statusCode int, resp interf
 		return 400, nil, fmt.Errorf("Unable to decode request: %s", err)
 	}
 
-	if err = stats.postToRedis(userInfo.UserId); err != nil {
+	conn, err := connectToRedis(ctx)
+	if err != nil {
+		return 500, nil, fmt.Errorf("Unable to connect to redis: %s", err)
+	}
+	defer conn.Close()
+
+	if err = stats.postToRedis(ctx, conn, userInfo.UserId); err != nil {
 		return 500, nil, fmt.Errorf("Unable to post stats: %s", err)
 	}
 
@@ -105,13 +158,14 @@ func postStats(r *http.Request, userInfo *UserInfo) (statusCode int, resp interf
 }
 
 // getStats handles a GET request to /stats
-func getStats(r *http.Request, userInfo *UserInfo) (statusCode int, resp interface{}, err error) {
-	conn, err := connectToRedis()
+func getStats(ctx context.Context, r *http.Request, userInfo *UserInfo) (statusCode int, resp interface{}, err error) {
+	conn, err := connectToRedis(ctx)
 	if err != nil {
 		return 500, nil, fmt.Errorf("Unable to connect to redis: %s", err)
 	}
+	defer conn.Close()
 
-	if resp, err = query(conn, userInfo.UserId); err != nil {
+	if resp, err = query(ctx, conn, userInfo.UserId); err != nil {
 		return 500, nil, fmt.Errorf("Unable to query stats: %s", err)
 	}
 
@@ -133,19 +187,44 @@ func getUserInfo(r *http.Request) (userInfo *UserInfo, err error) {
 	}
 	userInfo.UserId = int64(userIdInt)
 
-	// Figure out the Hash
-	hashes, ok := r.URL.Query()["hash"]
-	if !ok {
-		return nil, fmt.Errorf("No hash provided in querystring")
+	// Figure out the Hash. It's optional: a bearer-token client has none
+	// to provide, and authenticate overwrites UserId with the token's own
+	// once it's looked up, making the hash moot for that path.
+	if hashes, ok := r.URL.Query()["hash"]; ok && len(hashes) == 1 {
+		userInfo.Hash = hashes[0]
 	}
-	if len(hashes) != 1 {
-		return nil, fmt.Errorf("Wrong number of hashes provided in querystring")
-	}
-	userInfo.Hash = hashes[0]
 
 	return
 }
 
+// authenticate authenticates the request, preferring an "Authorization:
+// Bearer <token>" header over the OAuth + hash scheme so that
+// non-browser clients don't need a Google login. It also checks that
+// whichever credential was used grants requiredScope. When a bearer
+// token is used, userInfo.UserId is overwritten with the token's
+// UserId, since the URL's userid is otherwise unauthenticated. conn is
+// reused from the caller rather than dialed here, since every caller
+// already holds one for the rest of the request.
+func (userInfo *UserInfo) authenticate(ctx context.Context, conn redis.Conn, r *http.Request, requiredScope string) (statusCode int, err error) {
+	if tokenString := bearerToken(r); tokenString != "" {
+		token, err := lookupToken(ctx, conn, tokenString)
+		if err != nil {
+			return 500, fmt.Errorf("Unable to look up token: %s", err)
+		}
+		if token == nil {
+			return 401, fmt.Errorf("Not authenticated: unknown or expired token")
+		}
+		if !token.hasScope(requiredScope) {
+			return 403, fmt.Errorf("Token does not grant scope %s", requiredScope)
+		}
+
+		userInfo.UserId = token.UserId
+		return
+	}
+
+	return userInfo.authenticateAgainst(r)
+}
+
 // authenticateAgainst compares the Hash in the request with the hash
 // calculated based on the currently logged in user.
 func (userInfo *UserInfo) authenticateAgainst(r *http.Request) (statusCode int, err error) {
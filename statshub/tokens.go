@@ -0,0 +1,374 @@
+package statshub
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Scopes recognized by the token subsystem. A token may carry any
+// combination of these and is only good for the operations it lists.
+const (
+	ScopeSubmit = "submit"
+	ScopeQuery  = "query"
+)
+
+// Token represents a bearer token that can be used in place of the
+// Google OAuth + hash flow, primarily for non-browser clients that have
+// no convenient way to carry a logged-in Google session (mobile apps,
+// CLIs, other backend services). Tokens are bootstrapped via the
+// existing OAuth-authenticated flow and are stored in Redis only as a
+// sha256 digest, keyed "token:<hash>", so that a compromised Redis dump
+// cannot be replayed as a usable token.
+type Token struct {
+	UserId    int64
+	Scopes    []string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	Label     string
+}
+
+func init() {
+	http.HandleFunc("/tokens/", tokensHandler)
+}
+
+// tokensHandler handles requests to issue, list and revoke tokens for a
+// user. Like statsHandler, it identifies the target user from the URL
+// and authenticates the request against the currently logged in OAuth
+// user, so that a client can bootstrap a bearer token before it has one.
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo, err := getUserInfo(r)
+	if err != nil {
+		fail(w, 400, err)
+		return
+	}
+
+	statusCode, err := userInfo.authenticateAgainst(r)
+	if err != nil {
+		fail(w, statusCode, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout())
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var resp interface{}
+	switch r.Method {
+	case "POST":
+		statusCode, resp, err = issueTokenHandler(ctx, r, userInfo)
+	case "GET":
+		statusCode, resp, err = listTokensHandler(ctx, r, userInfo)
+	case "DELETE":
+		statusCode, resp, err = revokeTokenHandler(ctx, r, userInfo)
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	if err != nil {
+		fail(w, statusCodeFor(ctx, statusCode), err)
+	} else {
+		write(w, statusCode, resp)
+	}
+}
+
+// issueTokenResponse is the response to a successful token issuance. Token
+// is only ever returned here; it is never stored or logged in plaintext.
+type issueTokenResponse struct {
+	Succeeded bool
+	Token     string
+	Label     string
+	Scopes    []string
+	ExpiresAt time.Time
+}
+
+func issueTokenHandler(ctx context.Context, r *http.Request, userInfo *UserInfo) (statusCode int, resp interface{}, err error) {
+	label := r.URL.Query().Get("label")
+	scopes := parseScopes(r.URL.Query().Get("scopes"))
+	if len(scopes) == 0 {
+		return 400, nil, fmt.Errorf("At least one scope is required")
+	}
+
+	ttl := 0 * time.Second
+	if ttlString := r.URL.Query().Get("ttl"); ttlString != "" {
+		ttlSeconds, err := strconv.Atoi(ttlString)
+		if err != nil {
+			return 400, nil, fmt.Errorf("Unable to parse ttl %s: %s", ttlString, err)
+		}
+		ttl = time.Duration(ttlSeconds) * time.Second
+	}
+
+	conn, err := connectToRedis(ctx)
+	if err != nil {
+		return 500, nil, fmt.Errorf("Unable to connect to redis: %s", err)
+	}
+	defer conn.Close()
+
+	tokenString, token, err := issueToken(ctx, conn, userInfo.UserId, label, scopes, ttl)
+	if err != nil {
+		return 500, nil, fmt.Errorf("Unable to issue token: %s", err)
+	}
+
+	return 200, &issueTokenResponse{
+		Succeeded: true,
+		Token:     tokenString,
+		Label:     token.Label,
+		Scopes:    token.Scopes,
+		ExpiresAt: token.ExpiresAt,
+	}, nil
+}
+
+// listTokensResponse is the response to a token listing request. Id is
+// the token's digest and is safe to expose; it cannot be used to
+// authenticate, only to identify a token for revocation.
+type listTokensResponse struct {
+	Succeeded bool
+	Tokens    []tokenSummary
+}
+
+type tokenSummary struct {
+	Id        string
+	Label     string
+	Scopes    []string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func listTokensHandler(ctx context.Context, r *http.Request, userInfo *UserInfo) (statusCode int, resp interface{}, err error) {
+	conn, err := connectToRedis(ctx)
+	if err != nil {
+		return 500, nil, fmt.Errorf("Unable to connect to redis: %s", err)
+	}
+	defer conn.Close()
+
+	reply, err := doContext(ctx, conn, "SMEMBERS", userTokensKey(userInfo.UserId))
+	if err != nil {
+		return 500, nil, fmt.Errorf("Unable to list tokens: %s", err)
+	}
+	digests, err := redis.Strings(reply, nil)
+	if err != nil {
+		return 500, nil, fmt.Errorf("Unable to list tokens: %s", err)
+	}
+
+	summaries := make([]tokenSummary, 0, len(digests))
+	for _, digest := range digests {
+		token, err := lookupTokenByDigest(ctx, conn, digest)
+		if err != nil {
+			continue
+		}
+		if token == nil {
+			// Stale index entry for a token that expired or was revoked.
+			doContext(ctx, conn, "SREM", userTokensKey(userInfo.UserId), digest)
+			continue
+		}
+		summaries = append(summaries, tokenSummary{
+			Id:        digest,
+			Label:     token.Label,
+			Scopes:    token.Scopes,
+			CreatedAt: token.CreatedAt,
+			ExpiresAt: token.ExpiresAt,
+		})
+	}
+
+	return 200, &listTokensResponse{Succeeded: true, Tokens: summaries}, nil
+}
+
+func revokeTokenHandler(ctx context.Context, r *http.Request, userInfo *UserInfo) (statusCode int, resp interface{}, err error) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		return 400, nil, fmt.Errorf("id is required to revoke a token")
+	}
+
+	conn, err := connectToRedis(ctx)
+	if err != nil {
+		return 500, nil, fmt.Errorf("Unable to connect to redis: %s", err)
+	}
+	defer conn.Close()
+
+	if err = revokeToken(ctx, conn, userInfo.UserId, id); err != nil {
+		return 404, nil, fmt.Errorf("Unable to revoke token: %s", err)
+	}
+
+	return 200, &Response{Succeeded: true}, nil
+}
+
+// issueToken generates a new random token for userId, stores it in Redis
+// keyed by the sha256 digest of the token string and returns the
+// plaintext token (which is never itself persisted).
+func issueToken(ctx context.Context, conn redis.Conn, userId int64, label string, scopes []string, ttl time.Duration) (tokenString string, token *Token, err error) {
+	raw := make([]byte, 32)
+	if _, err = rand.Read(raw); err != nil {
+		return "", nil, fmt.Errorf("Unable to generate token: %s", err)
+	}
+	tokenString = hex.EncodeToString(raw)
+	digest := tokenDigest(tokenString)
+
+	now := time.Now()
+	token = &Token{
+		UserId:    userId,
+		Scopes:    scopes,
+		CreatedAt: now,
+		Label:     label,
+	}
+	if ttl > 0 {
+		token.ExpiresAt = now.Add(ttl)
+	}
+
+	key := tokenKey(digest)
+	args := []interface{}{key,
+		"userid", token.UserId,
+		"scopes", strings.Join(token.Scopes, ","),
+		"createdat", token.CreatedAt.Unix(),
+		"expiresat", token.ExpiresAt.Unix(),
+		"label", token.Label,
+	}
+	if _, err = doContext(ctx, conn, "HMSET", args...); err != nil {
+		return "", nil, fmt.Errorf("Unable to store token: %s", err)
+	}
+	if ttl > 0 {
+		if _, err = doContext(ctx, conn, "EXPIRE", key, int(ttl.Seconds())); err != nil {
+			return "", nil, fmt.Errorf("Unable to set token expiry: %s", err)
+		}
+	}
+	if _, err = doContext(ctx, conn, "SADD", userTokensKey(userId), digest); err != nil {
+		return "", nil, fmt.Errorf("Unable to index token: %s", err)
+	}
+
+	return tokenString, token, nil
+}
+
+// lookupToken looks up the Token corresponding to a bearer token string,
+// or returns a nil Token (no error) if it does not exist or has expired.
+func lookupToken(ctx context.Context, conn redis.Conn, tokenString string) (*Token, error) {
+	return lookupTokenByDigest(ctx, conn, tokenDigest(tokenString))
+}
+
+func lookupTokenByDigest(ctx context.Context, conn redis.Conn, digest string) (*Token, error) {
+	reply, err := doContext(ctx, conn, "HGETALL", tokenKey(digest))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to look up token: %s", err)
+	}
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to look up token: %s", err)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	var raw struct {
+		UserId    int64  `redis:"userid"`
+		Scopes    string `redis:"scopes"`
+		CreatedAt int64  `redis:"createdat"`
+		ExpiresAt int64  `redis:"expiresat"`
+		Label     string `redis:"label"`
+	}
+	if err = redis.ScanStruct(values, &raw); err != nil {
+		return nil, fmt.Errorf("Unable to parse token: %s", err)
+	}
+
+	token := &Token{
+		UserId:    raw.UserId,
+		Scopes:    parseScopes(raw.Scopes),
+		CreatedAt: time.Unix(raw.CreatedAt, 0),
+		Label:     raw.Label,
+	}
+	if raw.ExpiresAt > 0 {
+		token.ExpiresAt = time.Unix(raw.ExpiresAt, 0)
+		if token.ExpiresAt.Before(time.Now()) {
+			return nil, nil
+		}
+	}
+
+	return token, nil
+}
+
+// revokeToken immediately invalidates a token by deleting its Redis key,
+// after confirming the token actually belongs to userId so that learning
+// another user's token digest (from logs, a shared tool, etc.) isn't
+// enough to revoke it. id may be either the full digest or the token
+// string itself.
+func revokeToken(ctx context.Context, conn redis.Conn, userId int64, id string) error {
+	digest := id
+	token, err := lookupTokenByDigest(ctx, conn, digest)
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		// A token string is 64 hex characters, just like a digest, so
+		// length alone can't tell them apart: try it as a token string.
+		digest = tokenDigest(id)
+		if token, err = lookupTokenByDigest(ctx, conn, digest); err != nil {
+			return err
+		}
+	}
+	if token == nil || token.UserId != userId {
+		return fmt.Errorf("No such token for this user")
+	}
+
+	if _, err := doContext(ctx, conn, "DEL", tokenKey(digest)); err != nil {
+		return err
+	}
+	_, err = doContext(ctx, conn, "SREM", userTokensKey(userId), digest)
+	return err
+}
+
+// hasScope reports whether this token is allowed to perform the given
+// scope of operation.
+func (token *Token) hasScope(scope string) bool {
+	for _, s := range token.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenDigest(tokenString string) string {
+	hasher := sha256.New()
+	hasher.Write([]byte(tokenString))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func tokenKey(digest string) string {
+	return "token:" + digest
+}
+
+func userTokensKey(userId int64) string {
+	return fmt.Sprintf("usertokens:%d", userId)
+}
+
+func parseScopes(s string) []string {
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	scopes := make([]string, 0, len(parts))
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			scopes = append(scopes, part)
+		}
+	}
+	return scopes
+}
+
+// bearerToken extracts the raw token string from an "Authorization:
+// Bearer <token>" header, if present.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
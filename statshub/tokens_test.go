@@ -0,0 +1,156 @@
+package statshub
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIssueTokenRoundTripsScopes(t *testing.T) {
+	_, conn := newTestConn(t)
+	ctx := context.Background()
+
+	tokenString, token, err := issueToken(ctx, conn, 42, "test token", []string{ScopeSubmit}, 0)
+	if err != nil {
+		t.Fatalf("issueToken: %s", err)
+	}
+
+	looked, err := lookupToken(ctx, conn, tokenString)
+	if err != nil {
+		t.Fatalf("lookupToken: %s", err)
+	}
+	if looked == nil {
+		t.Fatal("expected token to be found")
+	}
+	if looked.UserId != 42 {
+		t.Fatalf("expected UserId 42, got %d", looked.UserId)
+	}
+	if looked.Label != token.Label {
+		t.Fatalf("expected label %q, got %q", token.Label, looked.Label)
+	}
+	if !looked.hasScope(ScopeSubmit) {
+		t.Fatal("expected token to have the submit scope")
+	}
+	if looked.hasScope(ScopeQuery) {
+		t.Fatal("expected token not to have the query scope")
+	}
+}
+
+func TestLookupTokenRejectsUnknownToken(t *testing.T) {
+	_, conn := newTestConn(t)
+	ctx := context.Background()
+
+	token, err := lookupToken(ctx, conn, "not-a-real-token")
+	if err != nil {
+		t.Fatalf("lookupToken: %s", err)
+	}
+	if token != nil {
+		t.Fatal("expected no token for an unknown token string")
+	}
+}
+
+func TestLookupTokenRejectsExpiredToken(t *testing.T) {
+	_, conn := newTestConn(t)
+	ctx := context.Background()
+
+	tokenString, _, err := issueToken(ctx, conn, 42, "short-lived", []string{ScopeSubmit}, time.Second)
+	if err != nil {
+		t.Fatalf("issueToken: %s", err)
+	}
+
+	// Rewrite the stored expiry into the past without waiting out the TTL.
+	if _, err := conn.Do("HSET", tokenKey(tokenDigest(tokenString)), "expiresat", time.Now().Add(-time.Minute).Unix()); err != nil {
+		t.Fatalf("HSET: %s", err)
+	}
+
+	token, err := lookupToken(ctx, conn, tokenString)
+	if err != nil {
+		t.Fatalf("lookupToken: %s", err)
+	}
+	if token != nil {
+		t.Fatal("expected an expired token to be treated as not found")
+	}
+}
+
+func TestAuthenticateEnforcesTokenScope(t *testing.T) {
+	_, conn := newTestConn(t)
+	ctx := context.Background()
+
+	queryOnly, _, err := issueToken(ctx, conn, 7, "query-only", []string{ScopeQuery}, 0)
+	if err != nil {
+		t.Fatalf("issueToken: %s", err)
+	}
+
+	r := httptest.NewRequest("POST", "/stats/7", nil)
+	r.Header.Set("Authorization", "Bearer "+queryOnly)
+
+	userInfo := &UserInfo{UserId: 7}
+	statusCode, err := userInfo.authenticate(ctx, conn, r, ScopeSubmit)
+	if err == nil {
+		t.Fatal("expected a query-only token to be rejected for the submit scope")
+	}
+	if statusCode != 403 {
+		t.Fatalf("expected status 403, got %d", statusCode)
+	}
+
+	r2 := httptest.NewRequest("GET", "/stats/7", nil)
+	r2.Header.Set("Authorization", "Bearer "+queryOnly)
+
+	userInfo2 := &UserInfo{UserId: 7}
+	if statusCode, err := userInfo2.authenticate(ctx, conn, r2, ScopeQuery); err != nil {
+		t.Fatalf("expected a query-only token to be accepted for the query scope, got status %d err %s", statusCode, err)
+	}
+}
+
+func TestAuthenticateRejectsUnknownToken(t *testing.T) {
+	_, conn := newTestConn(t)
+	ctx := context.Background()
+
+	r := httptest.NewRequest("POST", "/stats/7", nil)
+	r.Header.Set("Authorization", "Bearer not-a-real-token")
+
+	userInfo := &UserInfo{UserId: 7}
+	statusCode, err := userInfo.authenticate(ctx, conn, r, ScopeSubmit)
+	if err == nil {
+		t.Fatal("expected an unknown token to be rejected")
+	}
+	if statusCode != 401 {
+		t.Fatalf("expected status 401, got %d", statusCode)
+	}
+}
+
+func TestRevokeTokenRequiresOwnership(t *testing.T) {
+	_, conn := newTestConn(t)
+	ctx := context.Background()
+
+	tokenString, _, err := issueToken(ctx, conn, 1, "owner's token", []string{ScopeSubmit}, 0)
+	if err != nil {
+		t.Fatalf("issueToken: %s", err)
+	}
+	digest := tokenDigest(tokenString)
+
+	if err := revokeToken(ctx, conn, 2, digest); err == nil {
+		t.Fatal("expected revoking another user's token to fail")
+	}
+
+	token, err := lookupTokenByDigest(ctx, conn, digest)
+	if err != nil {
+		t.Fatalf("lookupTokenByDigest: %s", err)
+	}
+	if token == nil {
+		t.Fatal("expected token to survive a revoke attempt by a non-owner")
+	}
+
+	if err := revokeToken(ctx, conn, 1, digest); err != nil {
+		t.Fatalf("expected the owner to be able to revoke their own token: %s", err)
+	}
+
+	token, err = lookupTokenByDigest(ctx, conn, digest)
+	if err != nil {
+		t.Fatalf("lookupTokenByDigest: %s", err)
+	}
+	if token != nil {
+		t.Fatal("expected token to be gone after the owner revoked it")
+	}
+}